@@ -3,14 +3,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -30,6 +43,34 @@ type JSONSchema struct {
 	// it defines the location of the actual schema definition.
 	Ref string `json:"$ref"`
 
+	// OneOf, AnyOf, and AllOf are JSON Schema Draft-7 composition keywords,
+	// used by OpenAPI 3.x specs. Swagger 2.0 specs never populate these.
+	OneOf []*JSONSchema `json:"oneOf"`
+	AnyOf []*JSONSchema `json:"anyOf"`
+	AllOf []*JSONSchema `json:"allOf"`
+
+	// Nullable mirrors the OpenAPI 3.x keyword of the same name, indicating
+	// that a null value is acceptable in addition to Type.
+	Nullable bool `json:"nullable"`
+
+	// AdditionalProperties, when present, constrains the schema of map
+	// values for an object whose property set isn't fully enumerated.
+	AdditionalProperties *JSONSchema `json:"additionalProperties"`
+
+	// Format refines Type with a semantic hint, e.g. "date-time", "uuid",
+	// or "email", that the generator can use to produce more realistic
+	// stub values.
+	Format string `json:"format"`
+
+	// Example and Examples carry author-supplied sample values that the
+	// generator prefers over synthesizing its own.
+	Example  interface{}            `json:"example"`
+	Examples map[string]interface{} `json:"examples"`
+
+	// Required lists the property names an object value must contain,
+	// checked by -strict request validation.
+	Required []string `json:"required"`
+
 	XResourceID string `json:"x-resourceId"`
 }
 
@@ -64,8 +105,165 @@ type OpenAPIStatusCode string
 
 type ResourceID string
 
+// openAPI3Spec, openAPI3Operation, openAPI3Response, and openAPI3MediaType
+// mirror just enough of the OpenAPI 3.x document shape to normalize it into
+// the same OpenAPISpec/OpenAPIMethod IR that Swagger 2.0 specs produce, so
+// that the rest of the stub server (routing, generation) stays version
+// agnostic.
+type openAPI3Spec struct {
+	OpenAPI    string                                          `json:"openapi"`
+	Paths      map[OpenAPIPath]map[HTTPVerb]*openAPI3Operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*JSONSchema `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPI3Operation struct {
+	Description string                                 `json:"description"`
+	OperationID string                                 `json:"operationId"`
+	Parameters  []OpenAPIParameter                     `json:"parameters"`
+	RequestBody *openAPI3RequestBody                   `json:"requestBody"`
+	Responses   map[OpenAPIStatusCode]openAPI3Response `json:"responses"`
+}
+
+// openAPI3RequestBody mirrors the OpenAPI 3.x requestBody object. Unlike
+// Swagger 2.0, where the body is just another parameter with "in": "body",
+// OpenAPI 3.x splits it into its own top-level key.
+type openAPI3RequestBody struct {
+	Required bool                         `json:"required"`
+	Content  map[string]openAPI3MediaType `json:"content"`
+}
+
+type openAPI3Response struct {
+	Description string                       `json:"description"`
+	Content     map[string]openAPI3MediaType `json:"content"`
+}
+
+type openAPI3MediaType struct {
+	Schema *JSONSchema `json:"schema"`
+}
+
+// loadSpec detects whether data is a Swagger 2.0 or OpenAPI 3.x document
+// and unmarshals it into the common OpenAPISpec IR that the rest of the
+// stub server consumes, normalizing $ref targets along the way.
+func loadSpec(data []byte) (*OpenAPISpec, error) {
+	var probe struct {
+		Swagger string `json:"swagger"`
+		OpenAPI string `json:"openapi"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(probe.OpenAPI, "3.") {
+		return loadOpenAPI3Spec(data)
+	}
+	return loadSwagger2Spec(data)
+}
+
+func loadSwagger2Spec(data []byte) (*OpenAPISpec, error) {
+	var spec OpenAPISpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	normalizeSpecRefs(&spec)
+	return &spec, nil
+}
+
+func loadOpenAPI3Spec(data []byte) (*OpenAPISpec, error) {
+	var raw openAPI3Spec
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	spec := &OpenAPISpec{
+		Definitions: raw.Components.Schemas,
+		Paths:       make(map[OpenAPIPath]map[HTTPVerb]*OpenAPIMethod),
+	}
+
+	for path, verbs := range raw.Paths {
+		methods := make(map[HTTPVerb]*OpenAPIMethod)
+		for verb, op := range verbs {
+			responses := make(map[OpenAPIStatusCode]OpenAPIResponse)
+			for code, resp := range op.Responses {
+				responses[code] = OpenAPIResponse{
+					Description: resp.Description,
+					Schema:      resp.Content["application/json"].Schema,
+				}
+			}
+			parameters := op.Parameters
+			if op.RequestBody != nil {
+				parameters = append(parameters, OpenAPIParameter{
+					Name:     "body",
+					In:       "body",
+					Required: op.RequestBody.Required,
+					Schema:   op.RequestBody.Content["application/json"].Schema,
+				})
+			}
+
+			methods[verb] = &OpenAPIMethod{
+				Description: op.Description,
+				OperationID: op.OperationID,
+				Parameters:  parameters,
+				Responses:   responses,
+			}
+		}
+		spec.Paths[path] = methods
+	}
+
+	normalizeSpecRefs(spec)
+	return spec, nil
+}
+
+// normalizeSpecRefs rewrites every $ref in spec to point into Definitions
+// (OpenAPI 3.x specs refer to "#/components/schemas/X" rather than
+// Swagger 2.0's "#/definitions/X"), so that ref resolution elsewhere in the
+// stub server doesn't need to know which spec version it's working with.
+func normalizeSpecRefs(spec *OpenAPISpec) {
+	for _, schema := range spec.Definitions {
+		normalizeSchemaRefs(schema)
+	}
+	for _, verbs := range spec.Paths {
+		for _, method := range verbs {
+			for _, param := range method.Parameters {
+				normalizeSchemaRefs(param.Schema)
+			}
+			for code, response := range method.Responses {
+				normalizeSchemaRefs(response.Schema)
+				method.Responses[code] = response
+			}
+		}
+	}
+}
+
+func normalizeSchemaRefs(schema *JSONSchema) {
+	if schema == nil {
+		return
+	}
+
+	if schema.Ref != "" {
+		schema.Ref = strings.Replace(schema.Ref, "#/components/schemas/", "#/definitions/", 1)
+	}
+
+	normalizeSchemaRefs(schema.Items)
+	normalizeSchemaRefs(schema.AdditionalProperties)
+	for _, nested := range schema.Properties {
+		normalizeSchemaRefs(nested)
+	}
+	for _, nested := range schema.OneOf {
+		normalizeSchemaRefs(nested)
+	}
+	for _, nested := range schema.AnyOf {
+		normalizeSchemaRefs(nested)
+	}
+	for _, nested := range schema.AllOf {
+		normalizeSchemaRefs(nested)
+	}
+}
+
 type StubServerRoute struct {
 	pattern *regexp.Regexp
+	path    OpenAPIPath
 	method  *OpenAPIMethod
 }
 
@@ -73,32 +271,870 @@ type StubServer struct {
 	fixtures *Fixtures
 	routes   map[HTTPVerb][]StubServerRoute
 	spec     *OpenAPISpec
+
+	// captures holds request/response pairs recorded from a live upstream
+	// (in record mode) or loaded from disk to be served instead of
+	// synthetically generated data (in replay mode). It is nil unless
+	// -record or -replay was passed.
+	captures *CaptureStore
+
+	// upstream is set in record mode, and is the base URL that unmatched
+	// requests are proxied to.
+	upstream *url.URL
+
+	// resources backs stateful CRUD simulation for resources whose schema
+	// declares x-resourceId. Nil unless -state-file was passed.
+	resources *ResourceStore
+
+	// chaos maps path patterns to injected latency/errors/resets/
+	// truncation. Nil unless -chaos-config was passed.
+	chaos *ChaosConfig
+}
+
+// CaptureKey identifies a captured request by its method, path, and query
+// string, so that a replay can look up the response a live upstream gave
+// for the same request.
+type CaptureKey string
+
+func newCaptureKey(method, path, query string) CaptureKey {
+	if query == "" {
+		return CaptureKey(method + " " + path)
+	}
+	return CaptureKey(method + " " + path + "?" + query)
+}
+
+// CapturedResponse is a recorded upstream response, keyed by CaptureKey and
+// persisted to the fixtures file given by -replay.
+type CapturedResponse struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// CaptureStore is a collection of CapturedResponses that can be loaded from
+// and saved back to a JSON file on disk, so that a recording session can be
+// replayed later without the original upstream being reachable.
+type CaptureStore struct {
+	mu      sync.Mutex
+	entries map[CaptureKey]CapturedResponse
+}
+
+func newCaptureStore() *CaptureStore {
+	return &CaptureStore{entries: make(map[CaptureKey]CapturedResponse)}
+}
+
+func loadCaptureStore(path string) (*CaptureStore, error) {
+	store := newCaptureStore()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &store.entries); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (c *CaptureStore) get(key CaptureKey) (CapturedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp, ok := c.entries[key]
+	return resp, ok
+}
+
+func (c *CaptureStore) set(key CaptureKey, resp CapturedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = resp
+}
+
+func (c *CaptureStore) save(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// ResourceStore holds CRUD'd resources in memory, keyed first by resource
+// kind (a JSONSchema's x-resourceId, e.g. "charge") and then by resource
+// ID, so that a POST to a collection endpoint can be read back by later
+// GET/PUT/DELETE calls instead of each returning fresh fixture data.
+type ResourceStore struct {
+	mu    sync.Mutex
+	kinds map[string]map[string]map[string]interface{}
+}
+
+func newResourceStore() *ResourceStore {
+	return &ResourceStore{kinds: make(map[string]map[string]map[string]interface{})}
+}
+
+func loadResourceStore(path string) (*ResourceStore, error) {
+	store := newResourceStore()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &store.kinds); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// get returns a copy of the stored resource, so callers can read or mutate
+// it without racing a concurrent set/update/delete on the same id.
+func (rs *ResourceStore) get(kind, id string) (map[string]interface{}, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	obj, ok := rs.kinds[kind][id]
+	if !ok {
+		return nil, false
+	}
+	return copyResource(obj), true
+}
+
+func (rs *ResourceStore) set(kind, id string, data map[string]interface{}) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.kinds[kind] == nil {
+		rs.kinds[kind] = make(map[string]map[string]interface{})
+	}
+	rs.kinds[kind][id] = data
+}
+
+// update performs a locked read-modify-write: apply receives a private
+// copy of the stored resource and returns the replacement to store. This
+// keeps concurrent PUTs (or a PUT racing a GET/marshal of the same id)
+// from mutating a map that another goroutine is reading, which Go's
+// runtime treats as a fatal concurrent map access.
+func (rs *ResourceStore) update(kind, id string, apply func(map[string]interface{}) map[string]interface{}) (map[string]interface{}, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	existing, ok := rs.kinds[kind][id]
+	if !ok {
+		return nil, false
+	}
+
+	updated := apply(copyResource(existing))
+	rs.kinds[kind][id] = updated
+	return updated, true
 }
 
-func (s *StubServer) routeRequest(r *http.Request) *OpenAPIMethod {
+func (rs *ResourceStore) delete(kind, id string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	delete(rs.kinds[kind], id)
+}
+
+func copyResource(src map[string]interface{}) map[string]interface{} {
+	dst := make(map[string]interface{}, len(src))
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+func (rs *ResourceStore) save(path string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	data, err := json.MarshalIndent(rs.kinds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// newResourceID synthesizes an ID for a newly POSTed resource of the given
+// kind, loosely following the "kind_hex" convention common to OpenAPI
+// specs backing real payment APIs.
+func newResourceID(kind string) string {
+	return fmt.Sprintf("%s_%x", kind, rand.Int63())
+}
+
+// resourceIDFromPath picks out the resource ID a request's path refers to:
+// the sole path parameter if there's exactly one, the one named "id" if
+// there are several, or else the URL's final path segment.
+func resourceIDFromPath(r *http.Request, pathParams map[string]string) string {
+	if len(pathParams) == 1 {
+		for _, value := range pathParams {
+			return value
+		}
+	}
+	for name, value := range pathParams {
+		if strings.EqualFold(name, "id") {
+			return value
+		}
+	}
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	return segments[len(segments)-1]
+}
+
+// handleStatefulResource applies CRUD semantics for resources backed by a
+// ResourceStore: POST synthesizes an ID and stores the request body, GET
+// and PUT/DELETE operate on a previously stored object. It reports handled
+// as false when schema isn't a stateful resource (no x-resourceId), or
+// when no path parameter identifies which resource is being addressed, so
+// the caller can fall through to normal fixture generation.
+func (s *StubServer) handleStatefulResource(r *http.Request, schema *JSONSchema, pathParams map[string]string) (data interface{}, handled bool, err error) {
+	schema = resolveSchema(schema, s.spec.Definitions)
+	if schema == nil || schema.XResourceID == "" {
+		return nil, false, nil
+	}
+	kind := schema.XResourceID
+
+	switch r.Method {
+	case http.MethodPost:
+		if len(pathParams) > 0 {
+			// POST to an existing resource (e.g. an action endpoint), not
+			// a collection create; leave it to normal generation.
+			return nil, false, nil
+		}
+
+		body, readErr := ioutil.ReadAll(r.Body)
+		if readErr != nil {
+			return nil, true, readErr
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		payload := make(map[string]interface{})
+		if len(body) > 0 {
+			if unmarshalErr := json.Unmarshal(body, &payload); unmarshalErr != nil {
+				return nil, true, unmarshalErr
+			}
+		}
+
+		id := newResourceID(kind)
+		payload["id"] = id
+		s.resources.set(kind, id, payload)
+		return payload, true, nil
+
+	case http.MethodGet, http.MethodPut, http.MethodDelete:
+		if len(pathParams) == 0 {
+			return nil, false, nil
+		}
+		id := resourceIDFromPath(r, pathParams)
+
+		existing, found := s.resources.get(kind, id)
+		if !found {
+			return nil, false, nil
+		}
+
+		if r.Method == http.MethodDelete {
+			s.resources.delete(kind, id)
+			return map[string]interface{}{"id": id, "deleted": true}, true, nil
+		}
+
+		if r.Method == http.MethodPut {
+			body, readErr := ioutil.ReadAll(r.Body)
+			if readErr != nil {
+				return nil, true, readErr
+			}
+			r.Body.Close()
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			if len(body) > 0 {
+				updates := make(map[string]interface{})
+				if unmarshalErr := json.Unmarshal(body, &updates); unmarshalErr != nil {
+					return nil, true, unmarshalErr
+				}
+				updated, ok := s.resources.update(kind, id, func(obj map[string]interface{}) map[string]interface{} {
+					for k, v := range updates {
+						obj[k] = v
+					}
+					obj["id"] = id
+					return obj
+				})
+				if !ok {
+					// Deleted by a concurrent request between the get above
+					// and this update; treat it as not found.
+					return nil, false, nil
+				}
+				return updated, true, nil
+			}
+		}
+
+		return existing, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// latencyBucketBounds are the histogram bucket boundaries, in seconds,
+// used when rendering stub_request_duration_seconds on /metrics.
+var latencyBucketBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// routeMetrics accumulates Prometheus-style counters and a latency
+// histogram for a single route.
+type routeMetrics struct {
+	requestsByStatus map[int]int64
+	latencyBuckets   []int64
+	latencySum       float64
+	latencyCount     int64
+}
+
+// Metrics collects per-route request counts, status-code distribution, and
+// latency histograms, rendered in Prometheus text exposition format by
+// /metrics on the admin mux.
+type Metrics struct {
+	mu     sync.Mutex
+	routes map[string]*routeMetrics
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{routes: make(map[string]*routeMetrics)}
+}
+
+func (m *Metrics) observe(route, verb string, status int, elapsed time.Duration) {
+	key := verb + " " + route
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rm, ok := m.routes[key]
+	if !ok {
+		rm = &routeMetrics{
+			requestsByStatus: make(map[int]int64),
+			latencyBuckets:   make([]int64, len(latencyBucketBounds)),
+		}
+		m.routes[key] = rm
+	}
+
+	rm.requestsByStatus[status]++
+
+	seconds := elapsed.Seconds()
+	rm.latencySum += seconds
+	rm.latencyCount++
+	for i, bound := range latencyBucketBounds {
+		if seconds <= bound {
+			rm.latencyBuckets[i]++
+			break
+		}
+	}
+}
+
+// render formats the collected metrics in Prometheus text exposition
+// format.
+func (m *Metrics) render() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+
+	b.WriteString("# HELP stub_requests_total Total requests handled, by route and status code.\n")
+	b.WriteString("# TYPE stub_requests_total counter\n")
+	for route, rm := range m.routes {
+		for status, count := range rm.requestsByStatus {
+			fmt.Fprintf(&b, "stub_requests_total{route=%q,status=\"%d\"} %d\n", route, status, count)
+		}
+	}
+
+	b.WriteString("# HELP stub_request_duration_seconds Request latency in seconds, by route.\n")
+	b.WriteString("# TYPE stub_request_duration_seconds histogram\n")
+	for route, rm := range m.routes {
+		var cumulative int64
+		for i, bound := range latencyBucketBounds {
+			cumulative += rm.latencyBuckets[i]
+			fmt.Fprintf(&b, "stub_request_duration_seconds_bucket{route=%q,le=\"%v\"} %d\n", route, bound, cumulative)
+		}
+		fmt.Fprintf(&b, "stub_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, rm.latencyCount)
+		fmt.Fprintf(&b, "stub_request_duration_seconds_sum{route=%q} %v\n", route, rm.latencySum)
+		fmt.Fprintf(&b, "stub_request_duration_seconds_count{route=%q} %d\n", route, rm.latencyCount)
+	}
+
+	return b.String()
+}
+
+// requestMetrics is the process-wide metrics collector served by /metrics.
+var requestMetrics = newMetrics()
+
+// ready reports whether the server has finished initializing its router
+// and is prepared to serve traffic; flipped by main and read by /readyz.
+var ready int32
+
+// adminMux builds the admin HTTP handler exposing /healthz, /readyz,
+// /metrics, and /routes, per -admin-port.
+func adminMux(s *StubServer) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(requestMetrics.render()))
+	})
+
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		type routeInfo struct {
+			Verb string `json:"verb"`
+			Path string `json:"path"`
+		}
+
+		var routes []routeInfo
+		for verb, verbRoutes := range s.routes {
+			for _, route := range verbRoutes {
+				routes = append(routes, routeInfo{Verb: string(verb), Path: string(route.path)})
+			}
+		}
+		sort.Slice(routes, func(i, j int) bool {
+			if routes[i].Path != routes[j].Path {
+				return routes[i].Path < routes[j].Path
+			}
+			return routes[i].Verb < routes[j].Verb
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(routes)
+	})
+
+	return mux
+}
+
+// stubStatusHeader lets a client ask for a specific response defined in the
+// OpenAPI spec instead of the default "200", e.g. to exercise error paths.
+const stubStatusHeader = "X-Stub-Status"
+
+// stubStatusQueryParam is the query string equivalent of stubStatusHeader,
+// for clients that can't set arbitrary headers.
+const stubStatusQueryParam = "__status"
+
+// requestedStatusCode determines which spec'd response a client asked for,
+// via the X-Stub-Status header or the __status query parameter, defaulting
+// to "200" if neither is given.
+func requestedStatusCode(r *http.Request) OpenAPIStatusCode {
+	if status := r.Header.Get(stubStatusHeader); status != "" {
+		return OpenAPIStatusCode(status)
+	}
+	if status := r.URL.Query().Get(stubStatusQueryParam); status != "" {
+		return OpenAPIStatusCode(status)
+	}
+	return "200"
+}
+
+// pickErrorStatus deterministically picks a non-2xx response defined for
+// method, for use by -error-rate injection. Responses are considered in
+// sorted order so that injection is reproducible across runs.
+func pickErrorStatus(method *OpenAPIMethod) (OpenAPIStatusCode, bool) {
+	var codes []string
+	for code := range method.Responses {
+		if !strings.HasPrefix(string(code), "2") {
+			codes = append(codes, string(code))
+		}
+	}
+	if len(codes) == 0 {
+		return "", false
+	}
+	sort.Strings(codes)
+	return OpenAPIStatusCode(codes[0]), true
+}
+
+// routeRequest finds the OpenAPIMethod whose compiled path pattern matches
+// r, returning alongside it the route's OpenAPIPath (for logging and
+// metrics) and the named path parameters (e.g. {id}) pulled out of the
+// URL, for use by request validation.
+func (s *StubServer) routeRequest(r *http.Request) (*OpenAPIMethod, OpenAPIPath, map[string]string) {
 	verbRoutes := s.routes[HTTPVerb(r.Method)]
 	for _, route := range verbRoutes {
-		if route.pattern.MatchString(r.URL.Path) {
-			return route.method
+		match := route.pattern.FindStringSubmatch(r.URL.Path)
+		if match == nil {
+			continue
 		}
+
+		pathParams := make(map[string]string)
+		for i, name := range route.pattern.SubexpNames() {
+			if i == 0 || name == "" {
+				continue
+			}
+			pathParams[name] = match[i]
+		}
+		return route.method, route.path, pathParams
 	}
-	return nil
+	return nil, "", nil
+}
+
+// ValidationError describes a single parameter or body field that failed
+// -strict validation.
+type ValidationError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// ValidationResult is the structured 400 body returned in -strict mode
+// when a request doesn't satisfy its OpenAPIMethod's declared parameters.
+type ValidationResult struct {
+	Valid  bool              `json:"valid"`
+	Errors []ValidationError `json:"errors"`
+}
+
+// validateRequest checks that r carries each required path, query, and
+// header parameter declared by method, and that its JSON body has every
+// required property its schema declares (recursively), returning one
+// ValidationError per missing field. Parameter values and body fields are
+// not checked against their schemas' types, enums, or formats.
+func (s *StubServer) validateRequest(r *http.Request, method *OpenAPIMethod, pathParams map[string]string) []ValidationError {
+	var errs []ValidationError
+
+	for _, param := range method.Parameters {
+		switch param.In {
+		case "path":
+			if _, ok := pathParams[param.Name]; !ok && param.Required {
+				errs = append(errs, ValidationError{Field: param.Name, Reason: "missing required path parameter"})
+			}
+		case "query":
+			if param.Required && r.URL.Query().Get(param.Name) == "" {
+				errs = append(errs, ValidationError{Field: param.Name, Reason: "missing required query parameter"})
+			}
+		case "header":
+			if param.Required && r.Header.Get(param.Name) == "" {
+				errs = append(errs, ValidationError{Field: param.Name, Reason: "missing required header"})
+			}
+		case "body":
+			errs = append(errs, validateRequestBody(r, param, s.spec.Definitions)...)
+		}
+	}
+
+	return errs
+}
+
+// validateRequestBody reads and restores r.Body (so later handling can
+// still read it) and validates it against param's schema.
+func validateRequestBody(r *http.Request, param OpenAPIParameter, defs map[string]*JSONSchema) []ValidationError {
+	if r.Body == nil {
+		if param.Required {
+			return []ValidationError{{Field: param.Name, Reason: "missing required body"}}
+		}
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return []ValidationError{{Field: param.Name, Reason: "couldn't read request body"}}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if len(body) == 0 {
+		if param.Required {
+			return []ValidationError{{Field: param.Name, Reason: "missing required body"}}
+		}
+		return nil
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return []ValidationError{{Field: param.Name, Reason: "body is not valid JSON"}}
+	}
+
+	return validateSchema(param.Name, payload, param.Schema, defs)
+}
+
+// resolveSchema follows a single level of $ref into defs, so validation
+// works whether a parameter's schema is inline or references a definition.
+func resolveSchema(schema *JSONSchema, defs map[string]*JSONSchema) *JSONSchema {
+	if schema == nil || schema.Ref == "" {
+		return schema
+	}
+	name := strings.TrimPrefix(schema.Ref, "#/definitions/")
+	if resolved, ok := defs[name]; ok {
+		return resolved
+	}
+	return schema
+}
+
+// schemaExample returns an author-supplied example value for schema, if one
+// is present on the schema itself or on one of its oneOf/anyOf branches.
+// DataGenerator has no notion of these Draft-7 composition keywords, so
+// resolving examples here lets hand-authored samples take priority the way
+// the JSONSchema doc comment promises, even for OpenAPI 3.x schemas
+// DataGenerator can't otherwise interpret.
+func schemaExample(schema *JSONSchema, defs map[string]*JSONSchema) (interface{}, bool) {
+	if schema == nil {
+		return nil, false
+	}
+	schema = resolveSchema(schema, defs)
+
+	if schema.Example != nil {
+		return schema.Example, true
+	}
+	if len(schema.Examples) > 0 {
+		if v, ok := schema.Examples["default"]; ok {
+			return v, true
+		}
+		for _, v := range schema.Examples {
+			return v, true
+		}
+	}
+
+	for _, alt := range schema.OneOf {
+		if example, ok := schemaExample(alt, defs); ok {
+			return example, true
+		}
+	}
+	for _, alt := range schema.AnyOf {
+		if example, ok := schemaExample(alt, defs); ok {
+			return example, true
+		}
+	}
+
+	return nil, false
+}
+
+// resolveComposedSchema flattens the Draft-7 composition keywords
+// DataGenerator doesn't understand into a single schema it can generate
+// data for: allOf branches are merged into one object schema, and the
+// first oneOf/anyOf branch stands in as a representative shape. Schema
+// examples are checked separately, in schemaExample, before this is called.
+func resolveComposedSchema(schema *JSONSchema, defs map[string]*JSONSchema) *JSONSchema {
+	if schema == nil {
+		return nil
+	}
+	schema = resolveSchema(schema, defs)
+
+	if len(schema.AllOf) > 0 {
+		merged := &JSONSchema{
+			Type:       schema.Type,
+			Properties: make(map[string]*JSONSchema),
+			Nullable:   schema.Nullable,
+			Format:     schema.Format,
+		}
+		for k, v := range schema.Properties {
+			merged.Properties[k] = v
+		}
+		for _, branch := range schema.AllOf {
+			branch = resolveComposedSchema(branch, defs)
+			if branch == nil {
+				continue
+			}
+			if len(merged.Type) == 0 {
+				merged.Type = branch.Type
+			}
+			for k, v := range branch.Properties {
+				merged.Properties[k] = v
+			}
+			merged.Required = append(merged.Required, branch.Required...)
+		}
+		merged.Required = append(merged.Required, schema.Required...)
+		return merged
+	}
+
+	if len(schema.OneOf) > 0 {
+		return resolveComposedSchema(schema.OneOf[0], defs)
+	}
+	if len(schema.AnyOf) > 0 {
+		return resolveComposedSchema(schema.AnyOf[0], defs)
+	}
+
+	return schema
+}
+
+// applyFormatAndAdditionalProperties post-processes DataGenerator's output
+// to honor two JSONSchema keywords DataGenerator has no knowledge of:
+// Format rewrites a generated string with a realistic stub for the named
+// format (e.g. an RFC 3339 timestamp for "date-time"), and
+// AdditionalProperties adds one representative extra key, generated
+// against that schema, to demonstrate the object isn't limited to its
+// enumerated properties.
+func applyFormatAndAdditionalProperties(schema *JSONSchema, data interface{}, gen *DataGenerator, path string, defs map[string]*JSONSchema) interface{} {
+	if schema == nil {
+		return data
+	}
+	schema = resolveComposedSchema(schema, defs)
+
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for name, propSchema := range schema.Properties {
+			if value, ok := v[name]; ok {
+				v[name] = applyFormatAndAdditionalProperties(propSchema, value, gen, path, defs)
+			}
+		}
+		if schema.AdditionalProperties != nil {
+			if extra, err := gen.Generate(resolveComposedSchema(schema.AdditionalProperties, defs), path); err == nil {
+				v["additional"] = extra
+			}
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = applyFormatAndAdditionalProperties(schema.Items, item, gen, path, defs)
+		}
+		return v
+	case string:
+		if stub, ok := formatStub(schema.Format); ok {
+			return stub
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// formatStub returns a realistic stub value for a known JSON Schema
+// "format" hint, or ok=false if format is empty or unrecognized.
+func formatStub(format string) (string, bool) {
+	switch format {
+	case "date-time":
+		return time.Now().UTC().Format(time.RFC3339), true
+	case "date":
+		return time.Now().UTC().Format("2006-01-02"), true
+	case "email":
+		return "stub@example.com", true
+	case "uuid":
+		return "00000000-0000-4000-8000-000000000000", true
+	case "uri", "url":
+		return "https://example.com/stub", true
+	case "ipv4":
+		return "192.0.2.1", true
+	default:
+		return "", false
+	}
+}
+
+// validateSchema recursively checks that value satisfies schema's required
+// properties, resolving $refs against defs as it descends.
+func validateSchema(field string, value interface{}, schema *JSONSchema, defs map[string]*JSONSchema) []ValidationError {
+	schema = resolveSchema(schema, defs)
+	if schema == nil {
+		return nil
+	}
+
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var errs []ValidationError
+
+	for _, required := range schema.Required {
+		if _, ok := obj[required]; !ok {
+			errs = append(errs, ValidationError{Field: field + "." + required, Reason: "missing required property"})
+		}
+	}
+
+	for name, propSchema := range schema.Properties {
+		if propValue, ok := obj[name]; ok {
+			errs = append(errs, validateSchema(field+"."+name, propValue, propSchema, defs)...)
+		}
+	}
+
+	return errs
 }
 
 func (s *StubServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Request: %v %v", r.Method, r.URL.Path)
 	start := time.Now()
 
-	method := s.routeRequest(r)
+	route := "unmatched"
+
+	if s.chaos != nil {
+		if rule := s.chaos.match(r.Method, r.URL.Path); rule != nil {
+			if rule.LatencyMS > 0 || rule.LatencyStdDevMS > 0 {
+				delayMS := rule.LatencyMS
+				if rule.LatencyStdDevMS > 0 {
+					delayMS = chaosRand.NormFloat64()*rule.LatencyStdDevMS + rule.LatencyMS
+					if delayMS < 0 {
+						delayMS = 0
+					}
+				}
+				log.Printf("Chaos: delaying %v %v by %.1fms", r.Method, r.URL.Path, delayMS)
+				time.Sleep(time.Duration(delayMS * float64(time.Millisecond)))
+			}
+
+			if rule.ConnectionReset {
+				log.Printf("Chaos: resetting connection for %v %v", r.Method, r.URL.Path)
+				if hijacker, ok := w.(http.Hijacker); ok {
+					if conn, _, err := hijacker.Hijack(); err == nil {
+						if tcpConn, ok := conn.(*net.TCPConn); ok {
+							tcpConn.SetLinger(0)
+						}
+						conn.Close()
+					}
+				}
+				return
+			}
+
+			if rule.Status != 0 {
+				log.Printf("Chaos: forcing status %v for %v %v", rule.Status, r.Method, r.URL.Path)
+				s.writeResponse(w, r, "chaos", start, rule.Status, nil)
+				return
+			}
+
+			if rule.TruncateBytes > 0 {
+				w = &truncatingWriter{ResponseWriter: w, limit: rule.TruncateBytes}
+			}
+		}
+	}
+
+	key := newCaptureKey(r.Method, r.URL.Path, r.URL.RawQuery)
+
+	if s.captures != nil {
+		if captured, ok := s.captures.get(key); ok {
+			if verbose {
+				log.Printf("Replaying captured response for %v", key)
+			}
+			s.writeResponse(w, r, route, start, captured.StatusCode, captured.Body)
+			return
+		}
+	}
+
+	method, path, pathParams := s.routeRequest(r)
 	if method == nil {
-		writeResponse(w, start, http.StatusNotFound, nil)
+		if s.upstream != nil {
+			s.proxyAndCapture(w, r, start, key)
+			return
+		}
+		s.writeResponse(w, r, route, start, http.StatusNotFound, nil)
 		return
 	}
+	route = string(path)
 
-	response, ok := method.Responses["200"]
+	if strict {
+		if errs := s.validateRequest(r, method, pathParams); len(errs) > 0 {
+			log.Printf("Validation: %v error(s) across %v declared parameter(s)", len(errs), len(method.Parameters))
+			s.writeResponse(w, r, route, start, http.StatusBadRequest, ValidationResult{Valid: false, Errors: errs})
+			return
+		}
+		log.Printf("Validation: %v parameter(s) matched", len(method.Parameters))
+	}
+
+	statusCode := requestedStatusCode(r)
+	if errorRate > 0 && rand.Float64() < errorRate {
+		if injected, ok := pickErrorStatus(method); ok {
+			log.Printf("Injecting error response: %v", injected)
+			statusCode = injected
+		}
+	}
+
+	response, ok := method.Responses[statusCode]
 	if !ok {
-		log.Printf("Couldn't find 200 response in spec")
-		writeResponse(w, start, http.StatusInternalServerError, nil)
+		log.Printf("Couldn't find %v response in spec", statusCode)
+		s.writeResponse(w, r, route, start, http.StatusInternalServerError, nil)
 		return
 	}
 
@@ -106,14 +1142,84 @@ func (s *StubServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Response schema: %+v", response.Schema)
 	}
 
+	status, err := strconv.Atoi(string(statusCode))
+	if err != nil {
+		log.Printf("Non-numeric status code %v in spec, defaulting to 200", statusCode)
+		status = http.StatusOK
+	}
+
+	if s.resources != nil {
+		if data, handled, err := s.handleStatefulResource(r, response.Schema, pathParams); handled {
+			if err != nil {
+				log.Printf("Couldn't apply stateful resource: %v", err)
+				s.writeResponse(w, r, route, start, http.StatusInternalServerError, nil)
+				return
+			}
+			s.writeResponse(w, r, route, start, status, data)
+			return
+		}
+	}
+
+	if example, ok := schemaExample(response.Schema, s.spec.Definitions); ok {
+		s.writeResponse(w, r, route, start, status, example)
+		return
+	}
+
+	resolved := resolveComposedSchema(response.Schema, s.spec.Definitions)
 	generator := DataGenerator{s.spec.Definitions, s.fixtures}
-	data, err := generator.Generate(response.Schema, r.URL.Path)
+	data, err := generator.Generate(resolved, r.URL.Path)
 	if err != nil {
 		log.Printf("Couldn't generate response: %v", err)
-		writeResponse(w, start, http.StatusInternalServerError, nil)
+		s.writeResponse(w, r, route, start, http.StatusInternalServerError, nil)
 		return
 	}
-	writeResponse(w, start, http.StatusOK, data)
+	data = applyFormatAndAdditionalProperties(resolved, data, &generator, r.URL.Path, s.spec.Definitions)
+	s.writeResponse(w, r, route, start, status, data)
+}
+
+// writeResponse writes the response body like the package-level
+// writeResponse, additionally recording the request in requestMetrics
+// keyed by route: the matched OpenAPIPath, or one of the labels
+// "unmatched" (also used for replayed captures), "proxied", or "chaos".
+func (s *StubServer) writeResponse(w http.ResponseWriter, r *http.Request, route string, start time.Time, status int, data interface{}) {
+	writeResponse(w, start, status, data)
+	requestMetrics.observe(route, r.Method, status, time.Since(start))
+}
+
+// proxyAndCapture forwards a request that didn't match any route to the
+// live upstream configured with -record, captures the response body keyed
+// by method+path+query, and relays it back to the client.
+func (s *StubServer) proxyAndCapture(w http.ResponseWriter, r *http.Request, start time.Time, key CaptureKey) {
+	target := *s.upstream
+	target.Path = r.URL.Path
+	target.RawQuery = r.URL.RawQuery
+
+	proxyReq, err := http.NewRequest(r.Method, target.String(), r.Body)
+	if err != nil {
+		log.Printf("Couldn't build upstream request: %v", err)
+		s.writeResponse(w, r, "proxied", start, http.StatusInternalServerError, nil)
+		return
+	}
+	proxyReq.Header = r.Header
+
+	resp, err := http.DefaultClient.Do(proxyReq)
+	if err != nil {
+		log.Printf("Couldn't reach upstream %v: %v", s.upstream, err)
+		s.writeResponse(w, r, "proxied", start, http.StatusBadGateway, nil)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Couldn't read upstream response: %v", err)
+		s.writeResponse(w, r, "proxied", start, http.StatusBadGateway, nil)
+		return
+	}
+
+	log.Printf("Captured %v %v: status=%v", r.Method, r.URL.Path, resp.StatusCode)
+	s.captures.set(key, CapturedResponse{StatusCode: resp.StatusCode, Body: json.RawMessage(body)})
+	s.writeResponse(w, r, "proxied", start, resp.StatusCode, json.RawMessage(body))
 }
 
 func (s *StubServer) initializeRouter() {
@@ -136,6 +1242,7 @@ func (s *StubServer) initializeRouter() {
 
 			route := StubServerRoute{
 				pattern: pathPattern,
+				path:    path,
 				method:  method,
 			}
 
@@ -175,6 +1282,121 @@ func compilePath(path OpenAPIPath) *regexp.Regexp {
 	return regexp.MustCompile(pattern + `\z`)
 }
 
+// ChaosRule describes the chaos behavior to inject for requests whose path
+// matches PathPattern (and, if given, Methods): added latency, a forced
+// status code, a reset connection, or a truncated response body. The
+// first matching rule in a ChaosConfig wins.
+//
+// PathPattern is an OpenAPI-style path, e.g. "/v1/charges/{id}", compiled
+// the same way compilePath compiles spec paths into routes — not a raw
+// regular expression.
+type ChaosRule struct {
+	PathPattern string   `json:"path"`
+	Methods     []string `json:"methods,omitempty"`
+
+	// LatencyMS is a fixed delay, in milliseconds, added before
+	// responding. If LatencyStdDevMS is also set, the delay is instead
+	// sampled from a normal distribution with this mean.
+	LatencyMS       float64 `json:"latency_ms,omitempty"`
+	LatencyStdDevMS float64 `json:"latency_stddev_ms,omitempty"`
+
+	// Status, if nonzero, is written instead of generating a normal
+	// response.
+	Status int `json:"status,omitempty"`
+
+	// ConnectionReset, if true, hijacks and abruptly closes the
+	// connection instead of writing a response.
+	ConnectionReset bool `json:"connection_reset,omitempty"`
+
+	// TruncateBytes, if nonzero, cuts the response body short after this
+	// many bytes, simulating a malformed/partial response.
+	TruncateBytes int `json:"truncate_bytes,omitempty"`
+
+	compiled *regexp.Regexp
+}
+
+// ChaosConfig is the top-level document loaded from -chaos-config.
+type ChaosConfig struct {
+	Rules []*ChaosRule `json:"rules"`
+}
+
+// loadChaosConfig reads and parses the -chaos-config document. Only JSON
+// is supported: this binary has no YAML dependency available, so rather
+// than half-implement the format, -chaos-config and its help text are
+// scoped to JSON only.
+func loadChaosConfig(path string) (*ChaosConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config ChaosConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range config.Rules {
+		rule.compiled = compilePath(OpenAPIPath(rule.PathPattern))
+	}
+
+	return &config, nil
+}
+
+// match returns the first rule whose path pattern and (optional) method
+// list matches the given request, or nil if none do.
+func (c *ChaosConfig) match(method, path string) *ChaosRule {
+	for _, rule := range c.Rules {
+		if !rule.compiled.MatchString(path) {
+			continue
+		}
+		if len(rule.Methods) > 0 && !matchesMethod(rule.Methods, method) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+func matchesMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// chaosRand drives latency sampling; seeded from -chaos-seed in main so
+// that a chaos run can be reproduced.
+var chaosRand = rand.New(rand.NewSource(1))
+
+// truncatingWriter cuts a response body short after limit bytes, to
+// simulate a malformed or partial upstream response under chaos testing.
+type truncatingWriter struct {
+	http.ResponseWriter
+	limit   int
+	written int
+}
+
+func (tw *truncatingWriter) Write(p []byte) (int, error) {
+	remaining := tw.limit - tw.written
+	if remaining <= 0 {
+		return 0, io.ErrShortWrite
+	}
+
+	truncated := len(p) > remaining
+	if truncated {
+		p = p[:remaining]
+	}
+
+	n, err := tw.ResponseWriter.Write(p)
+	tw.written += n
+	if err == nil && truncated {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
 func writeResponse(w http.ResponseWriter, start time.Time, status int, data interface{}) {
 	if data == nil {
 		data = []byte(http.StatusText(status))
@@ -201,16 +1423,47 @@ func writeResponse(w http.ResponseWriter, start time.Time, status int, data inte
 // ---
 
 const defaultPort = 6065
+const defaultAdminPort = 6066
 
 // verbose tracks whether the program is operating in verbose mode
 var verbose bool
 
+// errorRate is the fraction of requests (0 to 1) for which a non-2xx
+// response is injected instead of the one the client asked for, to let
+// clients exercise retry/backoff paths. See -error-rate.
+var errorRate float64
+
+// strict enables request validation against the spec's declared
+// parameters and body schemas, rejecting non-conforming requests with a
+// 400 instead of generating a response for them. See -strict.
+var strict bool
+
 func main() {
 	var port int
 	var unix string
+	var record string
+	var replay string
+	var stateFile string
+	var tlsCert string
+	var tlsKey string
+	var adminPort int
+	var shutdownTimeout time.Duration
+	var chaosConfigFile string
+	var chaosSeed int64
 	flag.IntVar(&port, "port", 0, "Port to listen on")
 	flag.StringVar(&unix, "unix", "", "Unix socket to listen on")
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbose mode")
+	flag.Float64Var(&errorRate, "error-rate", 0, "Fraction of requests (0 to 1) to respond to with an injected error status")
+	flag.BoolVar(&strict, "strict", false, "Reject requests that don't satisfy the spec's declared parameters and body schemas with a 400")
+	flag.StringVar(&record, "record", "", "Upstream URL to forward unmatched requests to and capture their responses")
+	flag.StringVar(&replay, "replay", "", "Fixtures file of captured responses to prefer over generated data (also where -record writes captures on shutdown)")
+	flag.StringVar(&stateFile, "state-file", "", "File to persist created/updated resources to, so they survive a restart")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file; serves HTTPS instead of HTTP if set along with -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	flag.IntVar(&adminPort, "admin-port", defaultAdminPort, "Port for the admin mux (/healthz, /readyz, /metrics, /routes)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "How long to let in-flight requests drain on SIGINT/SIGTERM before forcing shutdown")
+	flag.StringVar(&chaosConfigFile, "chaos-config", "", "JSON config mapping path patterns to injected latency/errors/resets/truncation")
+	flag.Int64Var(&chaosSeed, "chaos-seed", 0, "Seed for chaos latency sampling; 0 picks a random seed each run")
 	flag.Parse()
 
 	if unix != "" && port != 0 {
@@ -218,14 +1471,21 @@ func main() {
 		log.Fatalf("Specify only one of -port or -unix")
 	}
 
+	if record != "" && replay == "" {
+		log.Fatalf("-record requires -replay to name the fixtures file to capture into")
+	}
+
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatalf("Specify both -tls-cert and -tls-key, or neither")
+	}
+
 	// Load the spec information from go-bindata
 	data, err := Asset("openapi/openapi/spec2.json")
 	if err != nil {
 		log.Fatalf("Error loading spec: %v", err)
 	}
 
-	var spec OpenAPISpec
-	err = json.Unmarshal(data, &spec)
+	spec, err := loadSpec(data)
 	if err != nil {
 		log.Fatalf("Error decoding spec: %v", err)
 	}
@@ -242,7 +1502,44 @@ func main() {
 		log.Fatalf("Error decoding spec: %v", err)
 	}
 
-	stub := StubServer{fixtures: &fixtures, spec: &spec}
+	stub := StubServer{fixtures: &fixtures, spec: spec}
+
+	if replay != "" {
+		stub.captures, err = loadCaptureStore(replay)
+		if err != nil {
+			log.Fatalf("Error loading captures from %v: %v", replay, err)
+		}
+		log.Printf("Loaded %v captured response(s) from %v", len(stub.captures.entries), replay)
+	}
+
+	if record != "" {
+		stub.upstream, err = url.Parse(record)
+		if err != nil {
+			log.Fatalf("Error parsing -record upstream URL: %v", err)
+		}
+		log.Printf("Recording unmatched requests to %v, capturing into %v", record, replay)
+	}
+
+	if stateFile != "" {
+		stub.resources, err = loadResourceStore(stateFile)
+		if err != nil {
+			log.Fatalf("Error loading resource state from %v: %v", stateFile, err)
+		}
+		log.Printf("Loaded resource state from %v", stateFile)
+	}
+
+	if chaosConfigFile != "" {
+		stub.chaos, err = loadChaosConfig(chaosConfigFile)
+		if err != nil {
+			log.Fatalf("Error loading chaos config from %v: %v", chaosConfigFile, err)
+		}
+		if chaosSeed == 0 {
+			chaosSeed = time.Now().UnixNano()
+		}
+		chaosRand = rand.New(rand.NewSource(chaosSeed))
+		log.Printf("Loaded %v chaos rule(s) from %v, seed=%v", len(stub.chaos.Rules), chaosConfigFile, chaosSeed)
+	}
+
 	stub.initializeRouter()
 
 	var listener net.Listener
@@ -260,7 +1557,74 @@ func main() {
 		log.Fatalf("Error listening on socket: %v", err)
 	}
 
-	http.HandleFunc("/", stub.handleRequest)
-	server := http.Server{}
-	server.Serve(listener)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", stub.handleRequest)
+	server := &http.Server{Handler: mux}
+
+	var adminListener net.Listener
+	var adminServer *http.Server
+	if adminPort > 0 {
+		adminListener, err = net.Listen("tcp", ":"+strconv.Itoa(adminPort))
+		if err != nil {
+			log.Fatalf("Error listening on admin socket: %v", err)
+		}
+		adminServer = &http.Server{Handler: adminMux(&stub)}
+		log.Printf("Serving admin endpoints on port %v", adminPort)
+	}
+
+	serverErrors := make(chan error, 2)
+	go func() {
+		if tlsCert != "" {
+			log.Printf("Serving HTTPS")
+			serverErrors <- server.ServeTLS(listener, tlsCert, tlsKey)
+		} else {
+			serverErrors <- server.Serve(listener)
+		}
+	}()
+	if adminServer != nil {
+		go func() {
+			serverErrors <- adminServer.Serve(adminListener)
+		}()
+	}
+
+	atomic.StoreInt32(&ready, 1)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case sig := <-signals:
+		log.Printf("Received %v, draining for up to %v", sig, shutdownTimeout)
+	case err := <-serverErrors:
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server error: %v", err)
+		}
+	}
+
+	atomic.StoreInt32(&ready, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down admin server: %v", err)
+		}
+	}
+
+	if record != "" {
+		log.Printf("Saving %v captured response(s) to %v", len(stub.captures.entries), replay)
+		if err := stub.captures.save(replay); err != nil {
+			log.Printf("Error saving captures: %v", err)
+		}
+	}
+	if stateFile != "" {
+		log.Printf("Saving resource state to %v", stateFile)
+		if err := stub.resources.save(stateFile); err != nil {
+			log.Printf("Error saving resource state: %v", err)
+		}
+	}
 }